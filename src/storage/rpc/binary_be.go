@@ -0,0 +1,43 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// binaryBEWireCodec is BinaryWire's framing with multi-byte integers in
+// network byte order, for peers that expect big-endian (e.g. tooling built
+// against other length-prefixed RPC stacks in the ecosystem).
+type binaryBEWireCodec struct{}
+
+func (binaryBEWireCodec) Name() string  { return "binary-be" }
+func (binaryBEWireCodec) Priority() int { return 50 }
+func (binaryBEWireCodec) New(rwc io.ReadWriteCloser, cfg *WireConfig) Wire {
+	if cfg == nil {
+		cfg = DefaultWireConfig()
+	}
+	// Copy before overriding ByteOrder: cfg is typically shared across many
+	// connections (e.g. one WireConfig reused in NegotiateWire for every
+	// accepted connection), and mutating it in place would silently flip
+	// unrelated connections - including ones that picked plain "binary" - to
+	// big-endian too.
+	beCfg := *cfg
+	beCfg.ByteOrder = binary.BigEndian
+	return NewBinaryWire(rwc, &beCfg)
+}
+
+func init() {
+	RegisterCodec(binaryBEWireCodec{})
+}
@@ -0,0 +1,196 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// BinWriter wraps an io.Writer and remembers the first error any of its
+// methods encountered. Once set, every subsequent call becomes a no-op, so
+// a sequence of writes can be chained without an if err != nil after each
+// one; callers check Err() once at the end.
+type BinWriter struct {
+	w     io.Writer
+	order binary.ByteOrder
+	err   error
+}
+
+// NewBinWriter returns a BinWriter writing little-endian integers to w.
+func NewBinWriter(w io.Writer) *BinWriter {
+	return NewBinWriterOrder(w, binary.LittleEndian)
+}
+
+// NewBinWriterOrder returns a BinWriter writing w, encoding integers in the
+// given byte order; this is what lets a single codec implementation back
+// both BinaryWire's little-endian and a big-endian variant.
+func NewBinWriterOrder(w io.Writer, order binary.ByteOrder) *BinWriter {
+	return &BinWriter{w: w, order: order}
+}
+
+// Err returns the first error encountered, if any.
+func (bw *BinWriter) Err() error {
+	return bw.err
+}
+
+// WriteU32 writes v as a uint32 in the writer's byte order.
+func (bw *BinWriter) WriteU32(v uint32) *BinWriter {
+	if bw.err != nil {
+		return bw
+	}
+	bw.err = binary.Write(bw.w, bw.order, v)
+	return bw
+}
+
+// WriteU64 writes v as a uint64 in the writer's byte order.
+func (bw *BinWriter) WriteU64(v uint64) *BinWriter {
+	if bw.err != nil {
+		return bw
+	}
+	bw.err = binary.Write(bw.w, bw.order, v)
+	return bw
+}
+
+// WriteU8 writes a single byte.
+func (bw *BinWriter) WriteU8(v byte) *BinWriter {
+	if bw.err != nil {
+		return bw
+	}
+	_, bw.err = bw.w.Write([]byte{v})
+	return bw
+}
+
+// WriteString writes a uint32 length prefix followed by s.
+func (bw *BinWriter) WriteString(s string) *BinWriter {
+	bw.WriteU32(uint32(len(s)))
+	if bw.err != nil || len(s) == 0 {
+		return bw
+	}
+	_, bw.err = io.WriteString(bw.w, s)
+	return bw
+}
+
+// WriteBytes writes a uint32 length prefix followed by data.
+func (bw *BinWriter) WriteBytes(data []byte) *BinWriter {
+	bw.WriteU32(uint32(len(data)))
+	if bw.err != nil || len(data) == 0 {
+		return bw
+	}
+	_, bw.err = bw.w.Write(data)
+	return bw
+}
+
+// BinReader wraps an io.Reader and remembers the first error any of its
+// methods encountered, mirroring BinWriter. ReadString/ReadBytes take the
+// maximum length the caller is willing to allocate for, so a frame that
+// lies about its own size never reaches io.ReadFull.
+type BinReader struct {
+	r     io.Reader
+	order binary.ByteOrder
+	err   error
+}
+
+// NewBinReader returns a BinReader reading little-endian integers from r.
+func NewBinReader(r io.Reader) *BinReader {
+	return NewBinReaderOrder(r, binary.LittleEndian)
+}
+
+// NewBinReaderOrder returns a BinReader reading from r, decoding integers
+// in the given byte order; this is what lets a single codec implementation
+// back both BinaryWire's little-endian and a big-endian variant.
+func NewBinReaderOrder(r io.Reader, order binary.ByteOrder) *BinReader {
+	return &BinReader{r: r, order: order}
+}
+
+// Err returns the first error encountered, if any.
+func (br *BinReader) Err() error {
+	return br.err
+}
+
+// ReadU32 reads a uint32 in the reader's byte order.
+func (br *BinReader) ReadU32() uint32 {
+	if br.err != nil {
+		return 0
+	}
+	var v uint32
+	br.err = binary.Read(br.r, br.order, &v)
+	return v
+}
+
+// ReadU8 reads a single byte.
+func (br *BinReader) ReadU8() byte {
+	if br.err != nil {
+		return 0
+	}
+	var buf [1]byte
+	if _, err := io.ReadFull(br.r, buf[:]); err != nil {
+		br.err = err
+		return 0
+	}
+	return buf[0]
+}
+
+// ReadU64 reads a uint64 in the reader's byte order.
+func (br *BinReader) ReadU64() uint64 {
+	if br.err != nil {
+		return 0
+	}
+	var v uint64
+	br.err = binary.Read(br.r, br.order, &v)
+	return v
+}
+
+// ReadString reads a uint32 length prefix followed by that many bytes,
+// refusing to allocate if the length exceeds *budget, and otherwise
+// deducting it from *budget so a caller can cap the total allocated across
+// several ReadString/ReadBytes calls on one frame rather than per call.
+func (br *BinReader) ReadString(budget *uint32) string {
+	length := br.ReadU32()
+	if br.err != nil || length == 0 {
+		return ""
+	}
+	if length > *budget {
+		br.err = ErrFrameTooLarge
+		return ""
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(br.r, data); err != nil {
+		br.err = err
+		return ""
+	}
+	*budget -= length
+	return string(data)
+}
+
+// ReadBytes reads a uint32 length prefix followed by that many bytes,
+// refusing to allocate if the length exceeds *budget, and otherwise
+// deducting it from *budget so a caller can cap the total allocated across
+// several ReadString/ReadBytes calls on one frame rather than per call.
+func (br *BinReader) ReadBytes(budget *uint32) []byte {
+	length := br.ReadU32()
+	if br.err != nil || length == 0 {
+		return nil
+	}
+	if length > *budget {
+		br.err = ErrFrameTooLarge
+		return nil
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(br.r, data); err != nil {
+		br.err = err
+		return nil
+	}
+	*budget -= length
+	return data
+}
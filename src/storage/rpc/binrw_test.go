@@ -0,0 +1,93 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestBinWriterBinReaderRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	bw := NewBinWriterOrder(&buf, binary.BigEndian)
+	bw.WriteU64(7).WriteU8(9).WriteString("cmd").WriteBytes([]byte("payload"))
+	if bw.Err() != nil {
+		t.Fatalf("write: %v", bw.Err())
+	}
+
+	br := NewBinReaderOrder(&buf, binary.BigEndian)
+	if got := br.ReadU64(); got != 7 {
+		t.Fatalf("ReadU64 = %d, want 7", got)
+	}
+	if got := br.ReadU8(); got != 9 {
+		t.Fatalf("ReadU8 = %d, want 9", got)
+	}
+	budget := uint32(1 << 20)
+	if got := br.ReadString(&budget); got != "cmd" {
+		t.Fatalf("ReadString = %q, want cmd", got)
+	}
+	if got := br.ReadBytes(&budget); string(got) != "payload" {
+		t.Fatalf("ReadBytes = %q, want payload", got)
+	}
+	if br.Err() != nil {
+		t.Fatalf("read: %v", br.Err())
+	}
+}
+
+// TestBinWriterStickyError pins that an error from the first write of a
+// chain is still reported by Err after the rest of the chain has run, which
+// lets callers chain writes without checking err after every one.
+func TestBinWriterStickyError(t *testing.T) {
+	bw := NewBinWriter(failingWriter{})
+	bw.WriteU32(1).WriteU64(2).WriteString("x")
+	if bw.Err() == nil {
+		t.Fatal("want non-nil Err after a failing write")
+	}
+}
+
+// TestBinReaderReadStringBudgetShared pins the shared-budget contract: a
+// length within a fresh budget succeeds and debits it, and a second read
+// that would exceed what's left of that same budget fails without touching
+// a fresh per-call limit.
+func TestBinReaderReadStringBudgetShared(t *testing.T) {
+	var buf bytes.Buffer
+	bw := NewBinWriter(&buf)
+	bw.WriteString("0123456789") // 10 bytes
+	bw.WriteBytes([]byte("0123456789"))
+	if bw.Err() != nil {
+		t.Fatalf("write: %v", bw.Err())
+	}
+
+	br := NewBinReader(&buf)
+	budget := uint32(15)
+	if got := br.ReadString(&budget); got != "0123456789" {
+		t.Fatalf("ReadString = %q, want 0123456789", got)
+	}
+	if budget != 5 {
+		t.Fatalf("budget after ReadString = %d, want 5", budget)
+	}
+	if got := br.ReadBytes(&budget); got != nil {
+		t.Fatalf("ReadBytes = %q, want nil once the shared budget is exhausted", got)
+	}
+	if br.Err() != ErrFrameTooLarge {
+		t.Fatalf("Err = %v, want ErrFrameTooLarge", br.Err())
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("boom")
+}
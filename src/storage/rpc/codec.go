@@ -0,0 +1,116 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"fmt"
+	"io"
+)
+
+// WireCodec is a registered wire format: framing plus encoding. BinaryWire
+// is one implementation; registering others here (see binary_be.go,
+// json_wire.go) lets operators run a mixed fleet - e.g. debug tooling
+// connecting with JSON while production stays on the binary codec - without
+// the Message type or the rpc server loop above Wire ever knowing which one
+// is in use.
+type WireCodec interface {
+	// Name is the identifier NewWire and NegotiateWire select codecs by.
+	Name() string
+	// Priority breaks ties when both peers support more than one codec;
+	// the higher value wins.
+	Priority() int
+	// New constructs a Wire of this codec over rwc. A nil cfg falls back
+	// to DefaultWireConfig.
+	New(rwc io.ReadWriteCloser, cfg *WireConfig) Wire
+}
+
+var codecRegistry = map[string]WireCodec{}
+
+// maxPeerCodecNames caps how many codec names NegotiateWire will read off
+// the wire for a peer's advertised list. The registry itself never holds
+// more than a handful, so a peerCount far beyond that can only be a
+// malformed or hostile peer; reject it up front rather than looping to
+// completion on an untrusted, attacker-controlled bound.
+const maxPeerCodecNames = 4096
+
+// RegisterCodec makes a WireCodec available to NewWire/NegotiateWire under
+// its Name. It is meant to be called from a codec implementation's init();
+// registering two codecs under the same name panics.
+func RegisterCodec(c WireCodec) {
+	if _, exists := codecRegistry[c.Name()]; exists {
+		panic(fmt.Sprintf("rpc: codec %q already registered", c.Name()))
+	}
+	codecRegistry[c.Name()] = c
+}
+
+// NewWire selects a registered codec by name and constructs a Wire over
+// rwc. A nil cfg falls back to DefaultWireConfig.
+func NewWire(rwc io.ReadWriteCloser, codecName string, cfg *WireConfig) (Wire, error) {
+	c, ok := codecRegistry[codecName]
+	if !ok {
+		return nil, fmt.Errorf("rpc: unknown wire codec %q", codecName)
+	}
+	return c.New(rwc, cfg), nil
+}
+
+// NegotiateWire exchanges the locally registered codec names with the peer
+// over rwc, picks the highest-priority codec both sides support, and
+// constructs a Wire with it. It must be the first thing either side does
+// with rwc; the exchange itself is a small codec-agnostic length-prefixed
+// list, independent of whichever codec wins.
+func NegotiateWire(rwc io.ReadWriteCloser, cfg *WireConfig) (Wire, error) {
+	local := make([]string, 0, len(codecRegistry))
+	for name := range codecRegistry {
+		local = append(local, name)
+	}
+
+	bw := NewBinWriter(rwc)
+	bw.WriteU32(uint32(len(local)))
+	for _, name := range local {
+		bw.WriteString(name)
+	}
+	if bw.Err() != nil {
+		return nil, bw.Err()
+	}
+
+	br := NewBinReader(rwc)
+	peerCount := br.ReadU32()
+	if br.Err() != nil {
+		return nil, br.Err()
+	}
+	if peerCount > maxPeerCodecNames {
+		return nil, fmt.Errorf("rpc: peer advertised an implausible number of codecs (%d)", peerCount)
+	}
+	peer := make(map[string]bool, peerCount)
+	for i := uint32(0); i < peerCount; i++ {
+		budget := uint32(defaultMaxFrameSize)
+		peer[br.ReadString(&budget)] = true
+	}
+	if br.Err() != nil {
+		return nil, br.Err()
+	}
+
+	var best WireCodec
+	for name, c := range codecRegistry {
+		if !peer[name] {
+			continue
+		}
+		if best == nil || c.Priority() > best.Priority() {
+			best = c
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("rpc: no wire codec in common with peer (local=%v, peer=%v)", local, peer)
+	}
+	return best.New(rwc, cfg), nil
+}
@@ -0,0 +1,162 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// jsonFrame mirrors Message with exported fields so encoding/json can see
+// them; Message's fields stay unexported for the binary codecs.
+type jsonFrame struct {
+	MagicVersion uint32 `json:"magic_version"`
+	Seq          uint64 `json:"seq"`
+	Typz         uint8  `json:"typz"`
+	Cmd          string `json:"cmd"`
+	Data         []byte `json:"data"`
+}
+
+// JSONWire implements Wire as a uint32 length prefix followed by a
+// JSON-encoded frame, for interop and debugging: operators can point a
+// plain JSON client at a production server without teaching it the binary
+// layout.
+type JSONWire struct {
+	conn   io.ReadWriteCloser
+	writer *bufio.Writer
+	reader io.Reader
+
+	maxFrameSize uint32
+}
+
+// NewJSONWire returns a new JSONWire. A nil cfg falls back to
+// DefaultWireConfig; JSONWire only honors cfg.MaxFrameSize, since checksums
+// and compression are binary-codec features.
+func NewJSONWire(rwc io.ReadWriteCloser, cfg *WireConfig) *JSONWire {
+	if cfg == nil {
+		cfg = DefaultWireConfig()
+	}
+	return &JSONWire{
+		conn:         rwc,
+		writer:       bufio.NewWriterSize(rwc, writeBufferSize),
+		reader:       bufio.NewReaderSize(rwc, readBufferSize),
+		maxFrameSize: cfg.MaxFrameSize,
+	}
+}
+
+// Handshake exchanges magicVersion and max frame size with the peer, same
+// as BinaryWire, but without a feature bitmask: JSONWire has no checksum or
+// compression modes to negotiate.
+func (w *JSONWire) Handshake() error {
+	if err := binary.Write(w.writer, binary.LittleEndian, uint32(MagicVersion)); err != nil {
+		return err
+	}
+	if err := binary.Write(w.writer, binary.LittleEndian, w.maxFrameSize); err != nil {
+		return err
+	}
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+
+	var peerVersion, peerMaxFrameSize uint32
+	if err := binary.Read(w.reader, binary.LittleEndian, &peerVersion); err != nil {
+		return err
+	}
+	if peerVersion != uint32(MagicVersion) {
+		return ErrBadMagic
+	}
+	if err := binary.Read(w.reader, binary.LittleEndian, &peerMaxFrameSize); err != nil {
+		return err
+	}
+	if peerMaxFrameSize < w.maxFrameSize {
+		w.maxFrameSize = peerMaxFrameSize
+	}
+	return nil
+}
+
+func (w *JSONWire) Write(msg *Message) error {
+	if msg == nil {
+		return errors.New("wire could not write empty message")
+	}
+	body, err := json.Marshal(&jsonFrame{
+		MagicVersion: msg.magicVersion,
+		Seq:          msg.seq,
+		Typz:         msg.typz,
+		Cmd:          msg.cmd,
+		Data:         msg.Data,
+	})
+	if err != nil {
+		return err
+	}
+	if uint32(len(body)) > w.maxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	bw := NewBinWriter(w.writer)
+	bw.WriteBytes(body)
+	if bw.Err() != nil {
+		return bw.Err()
+	}
+	return w.writer.Flush()
+}
+
+func (w *JSONWire) Read() (*Message, error) {
+	br := NewBinReader(w.reader)
+	budget := w.maxFrameSize
+	body := br.ReadBytes(&budget)
+	if br.Err() != nil {
+		return nil, br.Err()
+	}
+
+	var frame jsonFrame
+	if err := json.Unmarshal(body, &frame); err != nil {
+		return nil, err
+	}
+	if frame.MagicVersion != MagicVersion {
+		return nil, ErrBadMagic
+	}
+	return &Message{
+		magicVersion: frame.MagicVersion,
+		seq:          frame.Seq,
+		typz:         frame.Typz,
+		cmd:          frame.Cmd,
+		Data:         frame.Data,
+	}, nil
+}
+
+// Close close the wire
+func (w *JSONWire) Close() error {
+	return w.conn.Close()
+}
+
+// MaxFrameSize reports the negotiated (or configured, pre-Handshake) limit
+// on a single frame's length.
+func (w *JSONWire) MaxFrameSize() uint32 {
+	return w.maxFrameSize
+}
+
+// jsonWireCodec registers JSONWire under the name "json".
+type jsonWireCodec struct{}
+
+func (jsonWireCodec) Name() string  { return "json" }
+func (jsonWireCodec) Priority() int { return 10 }
+func (jsonWireCodec) New(rwc io.ReadWriteCloser, cfg *WireConfig) Wire {
+	return NewJSONWire(rwc, cfg)
+}
+
+func init() {
+	RegisterCodec(jsonWireCodec{})
+}
@@ -0,0 +1,427 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// record types exchanged between Session peers over a Wire, modeled on
+// FastCGI's record model: a request is a BeginRequest followed by zero or
+// more Params and Stdin records, and ends with an EndRequest (or is cut
+// short by an Abort).
+const (
+	RecordBeginRequest uint8 = iota
+	RecordParams
+	RecordStdin
+	RecordEndRequest
+	RecordAbort
+	RecordKeepAlive
+)
+
+// DefaultMaxInFlight is the maximum number of concurrent streams a Session
+// allows when SessionConfig.MaxInFlight is left at 0.
+const DefaultMaxInFlight = 1024
+
+// DefaultChunkSize is the largest Data payload a Session packs into a
+// single Stdin/EndRequest record when SessionConfig.ChunkSize is left at 0.
+// A record shorter than ChunkSize always marks the end of its stream's
+// payload. ChunkSize bounds each record, not the reassembled payload: a
+// stream's records are buffered until its last one arrives, with no cap on
+// their total size.
+const DefaultChunkSize = 32 << 10 // 32KB
+
+// sessionRecordOverhead is a generous upper bound on the bytes a record's
+// seq, typz and cmd/Data length prefixes add on top of ChunkSize worth of
+// payload, reserved when clamping ChunkSize to a Wire's MaxFrameSize so a
+// full-size chunk never itself exceeds the wire's limit.
+const sessionRecordOverhead = 256
+
+// DefaultInboundIdleTimeout is how long a peer-initiated stream may sit
+// between RecordBeginRequest and its terminal Stdin/Abort before the
+// Session reclaims it, when SessionConfig.InboundIdleTimeout is left at 0.
+const DefaultInboundIdleTimeout = 30 * time.Second
+
+// ErrSessionClosed is returned by Call and Serve once the Session's
+// underlying Wire has been closed.
+var ErrSessionClosed = errors.New("rpc: session closed")
+
+// ErrTooManyStreams is returned by Call when SessionConfig.MaxInFlight
+// concurrent streams are already outstanding.
+var ErrTooManyStreams = errors.New("rpc: too many in-flight streams")
+
+// Handler answers one multiplexed RPC call.
+type Handler func(cmd string, data []byte) ([]byte, error)
+
+// SessionConfig controls a Session's concurrency limits and chunking.
+type SessionConfig struct {
+	// MaxInFlight caps how many streamIDs may be outstanding on this
+	// Session at once. 0 means DefaultMaxInFlight.
+	MaxInFlight uint32
+	// ChunkSize is the largest Data payload packed into one record. 0
+	// means DefaultChunkSize.
+	ChunkSize uint32
+	// InboundIdleTimeout bounds how long a peer-initiated stream may stay
+	// open without its terminal Stdin/Abort arriving before the Session
+	// reclaims its MaxInFlight slot. 0 means DefaultInboundIdleTimeout.
+	InboundIdleTimeout time.Duration
+}
+
+// call tracks one in-flight Session.Call waiting for its EndRequest. It can
+// be completed from two independent goroutines - loop's routeResponse on a
+// normal EndRequest, and closeWithErr on a concurrent Close/Wire error - so
+// completion goes through once to make the close of done idempotent.
+type call struct {
+	buf  []byte
+	err  error
+	done chan struct{}
+	once sync.Once
+}
+
+// complete resolves the call with err exactly once; later calls are no-ops.
+func (c *call) complete(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
+
+// inflightReq accumulates the Stdin records of one request a peer is
+// sending us, until Serve's handler can be invoked with the whole payload.
+// timer reclaims its MaxInFlight slot if the stream's terminal Stdin/Abort
+// never arrives - otherwise a single stalled or malicious peer could wedge
+// the whole multiplexed connection by opening a BeginRequest and going
+// silent.
+type inflightReq struct {
+	cmd   string
+	buf   []byte
+	timer *time.Timer
+}
+
+// Session multiplexes many concurrent request/response exchanges over a
+// single Wire. Each record is tagged with a streamID (carried in the
+// underlying Message's seq field) and a record type (carried in typz),
+// obsoleting the one-request-per-connection assumption a bare seq implied.
+// Payloads larger than the configured ChunkSize are split across multiple
+// records and reassembled on the other end.
+type Session struct {
+	wire Wire
+	cfg  SessionConfig
+
+	nextStreamID uint32
+
+	mu           sync.Mutex
+	pending      map[uint32]*call
+	reqs         map[uint32]*inflightReq
+	inboundCount uint32
+	handler      Handler
+	closed       bool
+	closeErr     error
+	closedCh     chan struct{}
+
+	writeMu sync.Mutex
+}
+
+// NewSession returns a Session multiplexed over wire and starts reading
+// records from it in the background. A nil cfg falls back to
+// DefaultMaxInFlight/DefaultChunkSize.
+func NewSession(wire Wire, cfg *SessionConfig) *Session {
+	var local SessionConfig
+	if cfg != nil {
+		local = *cfg
+	}
+	if local.MaxInFlight == 0 {
+		local.MaxInFlight = DefaultMaxInFlight
+	}
+	if local.ChunkSize == 0 {
+		local.ChunkSize = DefaultChunkSize
+	}
+	if local.InboundIdleTimeout == 0 {
+		local.InboundIdleTimeout = DefaultInboundIdleTimeout
+	}
+	// A Stdin/EndRequest record is itself written through wire.Write, which
+	// enforces the wire's own (possibly much smaller) MaxFrameSize; clamp
+	// ChunkSize so a full-size chunk can never be rejected as too large.
+	if limit := wire.MaxFrameSize(); limit > sessionRecordOverhead {
+		if maxChunk := limit - sessionRecordOverhead; local.ChunkSize > maxChunk {
+			local.ChunkSize = maxChunk
+		}
+	}
+	s := &Session{
+		wire:     wire,
+		cfg:      local,
+		pending:  make(map[uint32]*call),
+		reqs:     make(map[uint32]*inflightReq),
+		closedCh: make(chan struct{}),
+	}
+	go s.loop()
+	return s
+}
+
+// Call sends cmd/data as a new stream and blocks for the matching
+// EndRequest. If ctx is canceled first, an Abort record is sent for the
+// stream and ctx.Err() is returned.
+func (s *Session) Call(ctx context.Context, cmd string, data []byte) ([]byte, error) {
+	streamID, c, err := s.newCall()
+	if err != nil {
+		return nil, err
+	}
+	defer s.forget(streamID)
+
+	if err := s.writeRecord(streamID, RecordBeginRequest, cmd, nil); err != nil {
+		return nil, err
+	}
+	if err := s.writeChunked(streamID, RecordStdin, data, ""); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-c.done:
+		return c.buf, c.err
+	case <-ctx.Done():
+		s.writeRecord(streamID, RecordAbort, "", nil)
+		return nil, ctx.Err()
+	case <-s.closedCh:
+		return nil, s.closeErr
+	}
+}
+
+// Serve registers handler for requests the peer begins on this Session and
+// blocks until the Session closes, returning the error that closed it.
+func (s *Session) Serve(handler Handler) error {
+	s.mu.Lock()
+	s.handler = handler
+	s.mu.Unlock()
+	<-s.closedCh
+	return s.closeErr
+}
+
+// Close closes the underlying Wire and fails every in-flight Call.
+func (s *Session) Close() error {
+	s.closeWithErr(ErrSessionClosed)
+	return s.wire.Close()
+}
+
+func (s *Session) newCall() (uint32, *call, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, nil, ErrSessionClosed
+	}
+	if uint32(len(s.pending)) >= s.cfg.MaxInFlight {
+		return 0, nil, ErrTooManyStreams
+	}
+	streamID := atomic.AddUint32(&s.nextStreamID, 1)
+	c := &call{done: make(chan struct{})}
+	s.pending[streamID] = c
+	return streamID, c, nil
+}
+
+func (s *Session) forget(streamID uint32) {
+	s.mu.Lock()
+	delete(s.pending, streamID)
+	s.mu.Unlock()
+}
+
+// tryBeginInbound admits one more peer-initiated request, enforcing
+// MaxInFlight on the serving side exactly as newCall does for outbound
+// Calls; without it a peer could open unbounded concurrent streams and
+// spawn unbounded handle goroutines.
+func (s *Session) tryBeginInbound() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inboundCount >= s.cfg.MaxInFlight {
+		return false
+	}
+	s.inboundCount++
+	return true
+}
+
+func (s *Session) endInbound() {
+	s.mu.Lock()
+	s.inboundCount--
+	s.mu.Unlock()
+}
+
+// beginInboundReq records a just-admitted peer-initiated stream and arms
+// its reclamation timer: if the stream's terminal Stdin/Abort never
+// arrives within InboundIdleTimeout, reapInboundReq frees its MaxInFlight
+// slot without one ever coming.
+func (s *Session) beginInboundReq(streamID uint32, cmd string) {
+	req := &inflightReq{cmd: cmd}
+	s.mu.Lock()
+	s.reqs[streamID] = req
+	s.mu.Unlock()
+	req.timer = time.AfterFunc(s.cfg.InboundIdleTimeout, func() { s.reapInboundReq(streamID) })
+}
+
+// reapInboundReq reclaims a stream's MaxInFlight slot once
+// InboundIdleTimeout has passed since its BeginRequest; Stdin records that
+// arrive in between do not restart the timer. It's a no-op if the stream already finished,
+// aborted or was reaped, since finishInboundReq's delete-and-check makes
+// exactly one of the two races win.
+func (s *Session) reapInboundReq(streamID uint32) {
+	s.mu.Lock()
+	_, ok := s.reqs[streamID]
+	delete(s.reqs, streamID)
+	s.mu.Unlock()
+	if ok {
+		s.endInbound()
+	}
+}
+
+// inboundReq looks up a peer-initiated stream's accumulator by streamID.
+func (s *Session) inboundReq(streamID uint32) (*inflightReq, bool) {
+	s.mu.Lock()
+	req, ok := s.reqs[streamID]
+	s.mu.Unlock()
+	return req, ok
+}
+
+// finishInboundReq removes streamID from s.reqs and disarms its
+// reclamation timer, reporting whether it was still present - false means
+// reapInboundReq already won the race and released the slot itself.
+func (s *Session) finishInboundReq(streamID uint32) (*inflightReq, bool) {
+	s.mu.Lock()
+	req, ok := s.reqs[streamID]
+	delete(s.reqs, streamID)
+	s.mu.Unlock()
+	if ok {
+		req.timer.Stop()
+	}
+	return req, ok
+}
+
+// loop is the Session's single reader: it dispatches inbound requests to
+// the registered handler and inbound responses to their waiting Call.
+func (s *Session) loop() {
+	for {
+		msg, err := s.wire.Read()
+		if err != nil {
+			s.closeWithErr(err)
+			return
+		}
+
+		streamID := uint32(msg.seq)
+		switch msg.typz {
+		case RecordBeginRequest:
+			if !s.tryBeginInbound() {
+				s.writeRecord(streamID, RecordEndRequest, "rpc: too many in-flight streams", nil)
+				continue
+			}
+			s.beginInboundReq(streamID, msg.cmd)
+		case RecordParams:
+			// reserved for future out-of-band metadata; unused today.
+		case RecordStdin:
+			req, ok := s.inboundReq(streamID)
+			if !ok {
+				continue
+			}
+			req.buf = append(req.buf, msg.Data...)
+			if uint32(len(msg.Data)) < s.cfg.ChunkSize {
+				if _, ok := s.finishInboundReq(streamID); ok {
+					go s.handle(streamID, req.cmd, req.buf)
+				}
+			}
+		case RecordAbort:
+			if _, ok := s.finishInboundReq(streamID); ok {
+				s.endInbound()
+			}
+		case RecordEndRequest:
+			s.routeResponse(streamID, msg.Data, msg.cmd)
+		case RecordKeepAlive:
+			// no-op: just keeps the connection from idling out upstream.
+		}
+	}
+}
+
+func (s *Session) handle(streamID uint32, cmd string, data []byte) {
+	defer s.endInbound()
+
+	s.mu.Lock()
+	handler := s.handler
+	s.mu.Unlock()
+
+	if handler == nil {
+		s.writeChunked(streamID, RecordEndRequest, nil, "rpc: no handler registered for session")
+		return
+	}
+	resp, err := handler(cmd, data)
+	errStr := ""
+	if err != nil {
+		errStr = err.Error()
+	}
+	s.writeChunked(streamID, RecordEndRequest, resp, errStr)
+}
+
+func (s *Session) routeResponse(streamID uint32, chunk []byte, errStr string) {
+	s.mu.Lock()
+	c, ok := s.pending[streamID]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	c.buf = append(c.buf, chunk...)
+	if uint32(len(chunk)) < s.cfg.ChunkSize {
+		var err error
+		if errStr != "" {
+			err = errors.New(errStr)
+		}
+		c.complete(err)
+	}
+}
+
+func (s *Session) closeWithErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.closeErr = err
+	for _, c := range s.pending {
+		c.complete(err)
+	}
+	close(s.closedCh)
+}
+
+func (s *Session) writeRecord(streamID uint32, recordType uint8, cmd string, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.wire.Write(&Message{
+		magicVersion: MagicVersion,
+		seq:          uint64(streamID),
+		typz:         recordType,
+		cmd:          cmd,
+		Data:         data,
+	})
+}
+
+// writeChunked splits data into records no larger than cfg.ChunkSize and
+// writes them as recordType, always finishing with a record shorter than
+// ChunkSize (possibly empty) so the receiver can recognize the last one
+// unambiguously. finalCmd rides along on that last record.
+func (s *Session) writeChunked(streamID uint32, recordType uint8, data []byte, finalCmd string) error {
+	for uint32(len(data)) >= s.cfg.ChunkSize {
+		chunk := data[:s.cfg.ChunkSize]
+		data = data[s.cfg.ChunkSize:]
+		if err := s.writeRecord(streamID, recordType, "", chunk); err != nil {
+			return err
+		}
+	}
+	return s.writeRecord(streamID, recordType, finalCmd, data)
+}
@@ -0,0 +1,239 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newSessionPair(t *testing.T, cfg *SessionConfig) (*Session, *Session) {
+	t.Helper()
+	return newSessionPairWithConfigs(t, cfg, cfg)
+}
+
+// newSessionPairWithConfigs is newSessionPair with independent configs per
+// side, for tests that need to pin a limit to one side of the connection
+// without the other side's own limit (e.g. Call's outbound MaxInFlight
+// check) confounding the result.
+func newSessionPairWithConfigs(t *testing.T, clientCfg, serverCfg *SessionConfig) (*Session, *Session) {
+	t.Helper()
+	client, server := tcpPipe(t)
+	cw := NewBinaryWire(client, DefaultWireConfig())
+	sw := NewBinaryWire(server, DefaultWireConfig())
+	return NewSession(cw, clientCfg), NewSession(sw, serverCfg)
+}
+
+func TestSessionCallServe(t *testing.T) {
+	clientSess, serverSess := newSessionPair(t, nil)
+	defer clientSess.Close()
+	defer serverSess.Close()
+
+	go serverSess.Serve(func(cmd string, data []byte) ([]byte, error) {
+		if cmd != "echo" {
+			t.Errorf("unexpected cmd %q", cmd)
+		}
+		return append([]byte("got:"), data...), nil
+	})
+	waitForHandler(t, serverSess)
+
+	resp, err := clientSess.Call(context.Background(), "echo", []byte("hi"))
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if !bytes.Equal(resp, []byte("got:hi")) {
+		t.Fatalf("resp = %q, want got:hi", resp)
+	}
+}
+
+// TestSessionLargePayloadChunking exercises a payload several times bigger
+// than ChunkSize, pinning the split/reassemble path on both the Stdin and
+// EndRequest directions.
+func TestSessionLargePayloadChunking(t *testing.T) {
+	cfg := &SessionConfig{ChunkSize: 64}
+	clientSess, serverSess := newSessionPair(t, cfg)
+	defer clientSess.Close()
+	defer serverSess.Close()
+
+	go serverSess.Serve(func(cmd string, data []byte) ([]byte, error) {
+		out := make([]byte, len(data))
+		copy(out, data)
+		return out, nil
+	})
+	waitForHandler(t, serverSess)
+
+	payload := bytes.Repeat([]byte("abcdefghij"), 50) // 500 bytes, >> ChunkSize
+	resp, err := clientSess.Call(context.Background(), "echo", payload)
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if !bytes.Equal(resp, payload) {
+		t.Fatal("reassembled payload did not round trip")
+	}
+}
+
+func TestSessionCallCanceledByContext(t *testing.T) {
+	clientSess, serverSess := newSessionPair(t, nil)
+	defer clientSess.Close()
+	defer serverSess.Close()
+
+	block := make(chan struct{})
+	go serverSess.Serve(func(cmd string, data []byte) ([]byte, error) {
+		<-block
+		return nil, nil
+	})
+	defer close(block)
+	waitForHandler(t, serverSess)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := clientSess.Call(ctx, "slow", nil); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+// TestSessionConcurrentCloseDoesNotPanic pins the fix for the routeResponse
+// vs closeWithErr race: both can try to complete the same call, and that
+// must be idempotent rather than double-closing call.done.
+func TestSessionConcurrentCloseDoesNotPanic(t *testing.T) {
+	clientSess, serverSess := newSessionPair(t, nil)
+	defer serverSess.Close()
+
+	go serverSess.Serve(func(cmd string, data []byte) ([]byte, error) {
+		return nil, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			clientSess.Call(context.Background(), "noop", nil)
+		}()
+	}
+	// Racing Close against in-flight EndRequest delivery is exactly the
+	// scenario that used to panic with "close of closed channel".
+	clientSess.Close()
+	wg.Wait()
+}
+
+// TestSessionInboundStreamsAreBounded pins the serving-side counterpart to
+// Call's MaxInFlight check: a peer that opens more concurrent streams than
+// the server's MaxInFlight gets rejected instead of starving unbounded
+// goroutines. The client side is given a generous MaxInFlight of its own so
+// only the server's inbound bound (tryBeginInbound/endInbound) can be what
+// rejects the second stream - not Call's pre-existing outbound cap in
+// newCall, which would otherwise confound this test since both ends
+// shared one cfg.
+func TestSessionInboundStreamsAreBounded(t *testing.T) {
+	clientSess, serverSess := newSessionPairWithConfigs(t,
+		&SessionConfig{MaxInFlight: 10},
+		&SessionConfig{MaxInFlight: 1},
+	)
+	defer clientSess.Close()
+	defer serverSess.Close()
+
+	block := make(chan struct{})
+	go serverSess.Serve(func(cmd string, data []byte) ([]byte, error) {
+		<-block
+		return nil, nil
+	})
+	waitForHandler(t, serverSess)
+
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, err := clientSess.Call(ctx, "slow", nil)
+			results <- err
+		}()
+	}
+
+	first := <-results
+	close(block)
+	second := <-results
+
+	errs := []error{first, second}
+	var rejected error
+	admitted := 0
+	for _, err := range errs {
+		if err != nil {
+			rejected = err
+		} else {
+			admitted++
+		}
+	}
+	if admitted != 1 {
+		t.Fatalf("want exactly one of two concurrent streams admitted, got errs=%v", errs)
+	}
+	if rejected == nil || rejected.Error() != "rpc: too many in-flight streams" {
+		t.Fatalf("rejected stream's error = %v, want the server's too-many-in-flight EndRequest error text", rejected)
+	}
+}
+
+// TestSessionInboundIdleStreamIsReclaimed pins the fix for a BeginRequest
+// with no matching terminal Stdin/Abort: without a per-stream idle
+// deadline it would permanently leak one MaxInFlight slot and eventually
+// starve every legitimate Call, server-side, for the life of the
+// connection.
+func TestSessionInboundIdleStreamIsReclaimed(t *testing.T) {
+	clientSess, serverSess := newSessionPairWithConfigs(t,
+		nil,
+		&SessionConfig{MaxInFlight: 1, InboundIdleTimeout: 20 * time.Millisecond},
+	)
+	defer clientSess.Close()
+	defer serverSess.Close()
+
+	go serverSess.Serve(func(cmd string, data []byte) ([]byte, error) {
+		return []byte("ok"), nil
+	})
+	waitForHandler(t, serverSess)
+
+	// A bare BeginRequest with no follow-up Stdin/Abort: exactly the
+	// malformed-peer scenario the idle timeout exists to reclaim from.
+	if err := clientSess.writeRecord(1, RecordBeginRequest, "stall", nil); err != nil {
+		t.Fatalf("writeRecord: %v", err)
+	}
+
+	// Give the server's idle timeout time to fire and reclaim the slot
+	// before exercising it; Call makes a single attempt and surfaces a
+	// too-many-in-flight rejection immediately rather than waiting for one.
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := clientSess.Call(ctx, "echo", nil); err != nil {
+		t.Fatalf("Call after idle slot should have been reclaimed: %v", err)
+	}
+}
+
+// waitForHandler blocks until s.Serve has registered its handler, so a test
+// can't race a Call against Serve's own goroutine still starting up.
+func waitForHandler(t *testing.T, s *Session) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		ready := s.handler != nil
+		s.mu.Unlock()
+		if ready {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("timed out waiting for Serve to register its handler")
+}
@@ -14,17 +14,99 @@ package rpc
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 )
 
 // Wire define a wire
 type Wire interface {
+	// Handshake negotiates the per-connection feature set with the peer. It
+	// must be called at most once, before the first Write/Read, and may be
+	// skipped entirely for compatibility with a peer that never handshakes.
+	Handshake() error
 	Write(*Message) error
 	Read() (*Message, error)
 	Close() error
+	// MaxFrameSize reports the largest cmd+Data length this Wire currently
+	// allocates for - the negotiated value once Handshake has run, or the
+	// locally configured one otherwise. Callers layering on top of a Wire
+	// (e.g. Session) use it to size their own framing so they never ask a
+	// Write for more than the Wire will allow.
+	MaxFrameSize() uint32
+}
+
+// feature bits negotiated during the Handshake. A feature only takes effect
+// once both peers have advertised it; unsupported bits are silently dropped.
+const (
+	FeatureChecksumCRC32C uint32 = 1 << iota
+	FeatureCompressSnappy
+	FeatureCompressZstd
+)
+
+// codec byte prepended to a frame's payload once compression has been
+// negotiated, identifying which (if any) algorithm compressed it.
+const (
+	codecNone byte = iota
+	codecSnappy
+	codecZstd
+)
+
+const (
+	// defaultMaxFrameSize bounds how large a single frame's cmd+Data may be
+	// before readString/readBytes refuse to allocate for it.
+	defaultMaxFrameSize = 64 << 20 // 64MB
+
+	// defaultCompressMinSize is the payload size above which a negotiated
+	// compression codec actually kicks in; small payloads aren't worth it.
+	defaultCompressMinSize = 1024
+)
+
+// ErrFrameTooLarge is returned when a peer attempts to send a frame whose
+// cmd/Data length exceeds the negotiated maxFrameSize, or when a local
+// caller attempts to write a frame whose encoded body (seq, typz, cmd, Data
+// and their length prefixes) exceeds it.
+var ErrFrameTooLarge = errors.New("rpc: frame exceeds negotiated max frame size")
+
+// ErrBadMagic is returned when a frame's magicVersion does not match
+// MagicVersion, replacing a per-call fmt.Errorf allocation on the hot path.
+var ErrBadMagic = errors.New("rpc: wrong API version received")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WireConfig carries the defaults a BinaryWire advertises during Handshake.
+// A nil *WireConfig passed to NewBinaryWire falls back to DefaultWireConfig.
+type WireConfig struct {
+	// Features is the bitmask of optional features (see FeatureChecksumCRC32C
+	// and friends) this end of the connection is willing to use.
+	Features uint32
+	// MaxFrameSize is the largest cmd+Data length this end will allocate
+	// for, and the value advertised to the peer during Handshake.
+	MaxFrameSize uint32
+	// CompressMinSize is the Data length above which a negotiated
+	// compression codec is actually applied.
+	CompressMinSize uint32
+	// ByteOrder is the integer encoding BinaryWire uses on the wire. A nil
+	// value means binary.LittleEndian; the binary-be WireCodec sets this to
+	// binary.BigEndian.
+	ByteOrder binary.ByteOrder
+}
+
+// DefaultWireConfig returns the configuration a BinaryWire uses when none is
+// supplied: no checksum, no compression, a 64MB max frame size. This matches
+// the behavior of a BinaryWire that never calls Handshake.
+func DefaultWireConfig() *WireConfig {
+	return &WireConfig{
+		Features:        0,
+		MaxFrameSize:    defaultMaxFrameSize,
+		CompressMinSize: defaultCompressMinSize,
+	}
 }
 
 // BinaryWire implements Wire interface
@@ -32,68 +114,173 @@ type BinaryWire struct {
 	conn   io.ReadWriteCloser
 	writer *bufio.Writer
 	reader io.Reader
+
+	cfg   *WireConfig
+	order binary.ByteOrder
+
+	// negotiated is the intersection of the local and peer feature bitmasks,
+	// filled in by Handshake. It stays 0 for a wire that never handshakes,
+	// which preserves today's unchecksummed, uncompressed wire format.
+	negotiated uint32
+	// maxFrameSize is the smaller of the local and peer advertised limits
+	// once Handshake has run; it defaults to cfg.MaxFrameSize until then.
+	maxFrameSize uint32
 }
 
-// NewBinaryWire returns a new BinaryWire
-func NewBinaryWire(rwc io.ReadWriteCloser) *BinaryWire {
+// NewBinaryWire returns a new BinaryWire. A nil cfg falls back to
+// DefaultWireConfig.
+func NewBinaryWire(rwc io.ReadWriteCloser, cfg *WireConfig) *BinaryWire {
+	if cfg == nil {
+		cfg = DefaultWireConfig()
+	}
+	order := cfg.ByteOrder
+	if order == nil {
+		order = binary.LittleEndian
+	}
 	return &BinaryWire{
-		conn:   rwc,
-		writer: bufio.NewWriterSize(rwc, writeBufferSize),
-		reader: bufio.NewReaderSize(rwc, readBufferSize),
+		conn:         rwc,
+		writer:       bufio.NewWriterSize(rwc, writeBufferSize),
+		reader:       bufio.NewReaderSize(rwc, readBufferSize),
+		cfg:          cfg,
+		order:        order,
+		maxFrameSize: cfg.MaxFrameSize,
 	}
 }
 
-func (w *BinaryWire) Write(msg *Message) error {
-	if msg == nil {
-		return errors.New("wire could not write empty message")
+// Handshake exchanges magicVersion, feature bitmask and max frame size with
+// the peer, and pins the negotiated settings for the rest of the
+// connection's lifetime. Peers that never call Handshake keep talking
+// today's plain, unchecksummed, uncompressed format.
+func (w *BinaryWire) Handshake() error {
+	if err := binary.Write(w.writer, w.order, uint32(MagicVersion)); err != nil {
+		return err
 	}
-	var err error
-	// LittleEndian: x86 cpu 为小端字节序
-	// 如 0x01234567，地址范围为0x100~0x103字节,小端字节序则存储为: 0x100: 67, 0x101: 45,..
-	if err = binary.Write(w.writer, binary.LittleEndian, msg.magicVersion); err != nil {
+	if err := binary.Write(w.writer, w.order, w.cfg.Features); err != nil {
 		return err
 	}
-	if err = binary.Write(w.writer, binary.LittleEndian, msg.seq); err != nil {
+	if err := binary.Write(w.writer, w.order, w.cfg.MaxFrameSize); err != nil {
 		return err
 	}
-	if err = binary.Write(w.writer, binary.LittleEndian, msg.typz); err != nil {
+	if err := w.writer.Flush(); err != nil {
 		return err
 	}
-	if err = w.writeString(msg.cmd); err != nil {
+
+	var peerVersion, peerFeatures, peerMaxFrameSize uint32
+	if err := binary.Read(w.reader, w.order, &peerVersion); err != nil {
 		return err
 	}
-	if err = w.writeBytes(msg.Data); err != nil {
+	if peerVersion != uint32(MagicVersion) {
+		return fmt.Errorf("rpc: wrong API version received during handshake: 0x%x", peerVersion)
+	}
+	if err := binary.Read(w.reader, w.order, &peerFeatures); err != nil {
+		return err
+	}
+	if err := binary.Read(w.reader, w.order, &peerMaxFrameSize); err != nil {
 		return err
 	}
+
+	w.negotiated = w.cfg.Features & peerFeatures
+	w.maxFrameSize = w.cfg.MaxFrameSize
+	if peerMaxFrameSize < w.maxFrameSize {
+		w.maxFrameSize = peerMaxFrameSize
+	}
+	return nil
+}
+
+func (w *BinaryWire) Write(msg *Message) error {
+	if msg == nil {
+		return errors.New("wire could not write empty message")
+	}
+
+	// Assemble seq|typz|cmd|codec|Data in a scratch buffer first: it lets us
+	// checksum and size-check the frame body before a single byte reaches
+	// the peer.
+	var body bytes.Buffer
+	bw := NewBinWriterOrder(&body, w.order)
+	bw.WriteU64(msg.seq).WriteU8(msg.typz).WriteString(msg.cmd)
+
+	data, codec, err := w.maybeCompress(msg.Data)
+	if err != nil {
+		return err
+	}
+	if w.negotiated&(FeatureCompressSnappy|FeatureCompressZstd) != 0 {
+		bw.WriteU8(codec)
+	}
+	bw.WriteBytes(data)
+	if bw.Err() != nil {
+		return bw.Err()
+	}
+	if uint32(body.Len()) > w.maxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	// LittleEndian: x86 cpu 为小端字节序
+	// 如 0x01234567，地址范围为0x100~0x103字节,小端字节序则存储为: 0x100: 67, 0x101: 45,..
+	out := NewBinWriterOrder(w.writer, w.order)
+	out.WriteU32(uint32(msg.magicVersion))
+	if out.Err() != nil {
+		return out.Err()
+	}
+	if _, err := w.writer.Write(body.Bytes()); err != nil {
+		return err
+	}
+	if w.negotiated&FeatureChecksumCRC32C != 0 {
+		sum := crc32.Checksum(body.Bytes(), crc32cTable)
+		if out.WriteU32(sum).Err() != nil {
+			return out.Err()
+		}
+	}
 	return w.writer.Flush()
 }
 
 func (w *BinaryWire) Read() (*Message, error) {
-	var (
-		msg Message
-		err error
-	)
+	var msg Message
 
-	if err = binary.Read(w.reader, binary.LittleEndian, &msg.magicVersion); err != nil {
+	var magicVersion uint32
+	if err := binary.Read(w.reader, w.order, &magicVersion); err != nil {
 		return nil, err
 	}
-
-	if msg.magicVersion != MagicVersion {
-		return nil, fmt.Errorf("Wrong API version received: 0x%x", &msg.magicVersion)
+	if magicVersion != uint32(MagicVersion) {
+		return nil, ErrBadMagic
 	}
+	msg.magicVersion = magicVersion
 
-	if err = binary.Read(w.reader, binary.LittleEndian, &msg.seq); err != nil {
-		return nil, err
+	// body mirrors exactly what Write checksums: seq|typz|cmd|codec|Data,
+	// not including magicVersion.
+	var body bytes.Buffer
+	br := NewBinReaderOrder(io.TeeReader(w.reader, &body), w.order)
+
+	msg.seq = br.ReadU64()
+	msg.typz = br.ReadU8()
+	// cmd and Data share one allocation budget so a frame can't force up to
+	// 2x maxFrameSize of allocation by maxing out both fields independently.
+	budget := w.maxFrameSize
+	msg.cmd = br.ReadString(&budget)
+
+	var codec byte
+	if w.negotiated&(FeatureCompressSnappy|FeatureCompressZstd) != 0 {
+		codec = br.ReadU8()
 	}
-	if err = binary.Read(w.reader, binary.LittleEndian, &msg.typz); err != nil {
-		return nil, err
+	msg.Data = br.ReadBytes(&budget)
+	if br.Err() != nil {
+		return nil, br.Err()
 	}
-	if msg.cmd, err = w.readString(); err != nil {
-		return nil, err
+
+	if w.negotiated&FeatureChecksumCRC32C != 0 {
+		var want uint32
+		if err := binary.Read(w.reader, w.order, &want); err != nil {
+			return nil, err
+		}
+		if got := crc32.Checksum(body.Bytes(), crc32cTable); got != want {
+			return nil, fmt.Errorf("rpc: checksum mismatch: want 0x%x got 0x%x", want, got)
+		}
 	}
-	if msg.Data, err = w.readBytes(); err != nil {
+
+	var err error
+	if msg.Data, err = w.maybeDecompress(msg.Data, codec); err != nil {
 		return nil, err
 	}
+
 	return &msg, nil
 }
 
@@ -102,53 +289,62 @@ func (w *BinaryWire) Close() error {
 	return w.conn.Close()
 }
 
-func (w *BinaryWire) readString() (string, error) {
-	var length uint32
-	if err := binary.Read(w.reader, binary.LittleEndian, &length); err != nil {
-		return "", err
-	}
-	if length <= 0 {
-		return "", nil
-	}
-	data := make([]byte, length)
-	if _, err := io.ReadFull(w.reader, data); err != nil {
-		return "", err
-	}
-	return string(data), nil
+// MaxFrameSize reports the negotiated (or configured, pre-Handshake) limit
+// on a single frame's cmd+Data length.
+func (w *BinaryWire) MaxFrameSize() uint32 {
+	return w.maxFrameSize
 }
 
-func (w *BinaryWire) writeString(s string) error {
-	if err := binary.Write(w.writer, binary.LittleEndian, uint32(len(s))); err != nil {
-		return err
+// maybeCompress compresses data with the higher-priority negotiated codec
+// (zstd over snappy) once it clears cfg.CompressMinSize, reporting which
+// codec byte was used so the peer knows how to reverse it.
+func (w *BinaryWire) maybeCompress(data []byte) ([]byte, byte, error) {
+	if uint32(len(data)) <= w.cfg.CompressMinSize {
+		return data, codecNone, nil
 	}
-	if _, err := w.writer.WriteString(s); err != nil {
-		return err
+	switch {
+	case w.negotiated&FeatureCompressZstd != 0:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, codecNone, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(data, nil), codecZstd, nil
+	case w.negotiated&FeatureCompressSnappy != 0:
+		return snappy.Encode(nil, data), codecSnappy, nil
+	default:
+		return data, codecNone, nil
 	}
-	return nil
 }
 
-func (w *BinaryWire) readBytes() (data []byte, err error) {
-	var length uint32
-	if err = binary.Read(w.reader, binary.LittleEndian, &length); err != nil {
-		return nil, err
-	}
-	if length > 0 {
-		data = make([]byte, length)
-		if _, err = io.ReadFull(w.reader, data); err != nil {
+func (w *BinaryWire) maybeDecompress(data []byte, codec byte) ([]byte, error) {
+	switch codec {
+	case codecNone:
+		return data, nil
+	case codecSnappy:
+		return snappy.Decode(nil, data)
+	case codecZstd:
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
 			return nil, err
 		}
+		defer dec.Close()
+		return dec.DecodeAll(data, nil)
+	default:
+		return nil, fmt.Errorf("rpc: unknown compression codec byte 0x%x", codec)
 	}
-	return
 }
 
-func (w *BinaryWire) writeBytes(data []byte) (err error) {
-	if err = binary.Write(w.writer, binary.LittleEndian, uint32(len(data))); err != nil {
-		return err
-	}
-	if len(data) > 0 {
-		if _, err = w.writer.Write(data); err != nil {
-			return err
-		}
-	}
-	return
-}
\ No newline at end of file
+// binaryWireCodec registers BinaryWire's little-endian framing under the
+// name "binary", the highest-priority and default codec.
+type binaryWireCodec struct{}
+
+func (binaryWireCodec) Name() string  { return "binary" }
+func (binaryWireCodec) Priority() int { return 100 }
+func (binaryWireCodec) New(rwc io.ReadWriteCloser, cfg *WireConfig) Wire {
+	return NewBinaryWire(rwc, cfg)
+}
+
+func init() {
+	RegisterCodec(binaryWireCodec{})
+}
@@ -0,0 +1,186 @@
+/*
+ * Tencent is pleased to support the open source community by making 蓝鲸 available.
+ * Copyright (C) 2017-2018 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPipe returns two ends of a real TCP loopback connection. BinaryWire's
+// Handshake has both ends Write-then-Flush before Read, which deadlocks on
+// an unbuffered net.Pipe; a real socket has enough kernel buffering for a
+// handshake-sized payload.
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	acceptCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			acceptCh <- nil
+			return
+		}
+		acceptCh <- conn
+	}()
+
+	client, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	server := <-acceptCh
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	return client, server
+}
+
+func TestBinaryWireHandshakeAndChecksum(t *testing.T) {
+	client, server := tcpPipe(t)
+	defer client.Close()
+	defer server.Close()
+
+	cfg := &WireConfig{Features: FeatureChecksumCRC32C, MaxFrameSize: defaultMaxFrameSize}
+	cw := NewBinaryWire(client, cfg)
+	sw := NewBinaryWire(server, cfg)
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- cw.Handshake() }()
+	go func() { errCh <- sw.Handshake() }()
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+	}
+
+	msg := &Message{magicVersion: MagicVersion, seq: 42, typz: 1, cmd: "ping", Data: []byte("hello")}
+	go func() {
+		if err := cw.Write(msg); err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- nil
+	}()
+
+	got, err := sw.Read()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got.cmd != msg.cmd || string(got.Data) != string(msg.Data) || got.seq != msg.seq {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", got, msg)
+	}
+}
+
+func TestBinaryWireRejectsOversizedFrame(t *testing.T) {
+	client, server := tcpPipe(t)
+	defer client.Close()
+	defer server.Close()
+
+	cfg := &WireConfig{MaxFrameSize: 8}
+	cw := NewBinaryWire(client, cfg)
+	sw := NewBinaryWire(server, cfg)
+
+	if err := cw.Write(&Message{magicVersion: MagicVersion, cmd: "this command is way too long"}); err != ErrFrameTooLarge {
+		t.Fatalf("want ErrFrameTooLarge, got %v", err)
+	}
+	_ = sw // no bytes were sent; nothing to read
+}
+
+// TestBinaryWireBudgetIsSharedAcrossCmdAndData pins the cumulative-budget
+// fix: cmd and Data split one maxFrameSize allocation budget, so a peer
+// can't force close to 2x maxFrameSize by maxing out both fields.
+func TestBinaryWireBudgetIsSharedAcrossCmdAndData(t *testing.T) {
+	client, server := tcpPipe(t)
+	defer client.Close()
+	defer server.Close()
+
+	const limit = 16
+	cw := NewBinaryWire(client, &WireConfig{MaxFrameSize: 1 << 20})
+	sw := NewBinaryWire(server, &WireConfig{MaxFrameSize: limit})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- cw.Write(&Message{
+			magicVersion: MagicVersion,
+			cmd:          "0123456789",         // 10 bytes, under limit on its own
+			Data:         []byte("0123456789"), // another 10 bytes, under limit on its own
+		})
+	}()
+
+	if _, err := sw.Read(); err != ErrFrameTooLarge {
+		t.Fatalf("want ErrFrameTooLarge once cmd+Data exceed the shared budget, got %v", err)
+	}
+	<-errCh
+}
+
+func TestBinaryWireCompressionSnappyRoundTrip(t *testing.T) {
+	testBinaryWireCompressionRoundTrip(t, FeatureCompressSnappy)
+}
+
+func TestBinaryWireCompressionZstdRoundTrip(t *testing.T) {
+	testBinaryWireCompressionRoundTrip(t, FeatureCompressZstd)
+}
+
+// testBinaryWireCompressionRoundTrip drives a full Handshake (so the
+// feature bit actually gets negotiated, not just configured) followed by a
+// Write/Read round trip of a payload well over CompressMinSize, pinning
+// that maybeCompress/maybeDecompress actually compress and reverse it
+// rather than only exercising the codecNone fallthrough.
+func testBinaryWireCompressionRoundTrip(t *testing.T, feature uint32) {
+	t.Helper()
+	client, server := tcpPipe(t)
+	defer client.Close()
+	defer server.Close()
+
+	cfg := &WireConfig{
+		Features:        feature,
+		MaxFrameSize:    defaultMaxFrameSize,
+		CompressMinSize: 16,
+	}
+	cw := NewBinaryWire(client, cfg)
+	sw := NewBinaryWire(server, cfg)
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- cw.Handshake() }()
+	go func() { errCh <- sw.Handshake() }()
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+	}
+
+	payload := bytes.Repeat([]byte("compress-me-"), 200) // well over CompressMinSize
+	msg := &Message{magicVersion: MagicVersion, seq: 1, cmd: "blob", Data: payload}
+	go func() { errCh <- cw.Write(msg) }()
+
+	got, err := sw.Read()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if !bytes.Equal(got.Data, payload) {
+		t.Fatalf("decompressed payload mismatch: got %d bytes, want %d bytes", len(got.Data), len(payload))
+	}
+}